@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the parsed contents of netupvim.ini. Every field is optional:
+// a zero value means "use the built-in default", which the getXxx accessors
+// below apply rather than baking it into the zero value itself.
+type config struct {
+	TargetDir         string
+	Source            string
+	CPU               string
+	DisableSelfUpdate bool
+
+	DownloadTimeout string
+	GithubUser      string
+	GithubToken     string
+	GithubVerbose   bool
+	LogRotateCount  int
+	ExeRotateCount  int
+
+	// DownloadRetries/DownloadBackoff tune the retry loop wrapped around
+	// download in source.go.
+	DownloadRetries int
+	DownloadBackoff string
+
+	// CustomSources holds raw "<scheme>://..." URLs (as understood by
+	// newSource in source.go) keyed by source type name ("release",
+	// "develop", "canary"), optionally with a per-arch suffix such as
+	// "release.x86", read from the [CustomSource] section. Each overrides
+	// that source's built-in provider.
+	CustomSources map[string]string
+
+	// ProgressMode selects the Progress backend (progress.go): "console"
+	// (default), "json", or "silent".
+	ProgressMode string
+}
+
+// loadConfig reads an ini file at path. A missing file is not an error: it
+// just means every setting falls back to its default.
+func loadConfig(path string) (*config, error) {
+	c := &config{CustomSources: map[string]string{}}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	section := ""
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if section == "CustomSource" {
+			c.CustomSources[key] = val
+			continue
+		}
+		if err := c.set(key, val); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// set applies one "Key = Value" line from the default (unnamed) section to c.
+func (c *config) set(key, val string) error {
+	switch key {
+	case "TargetDir":
+		c.TargetDir = val
+	case "Source":
+		c.Source = val
+	case "CPU":
+		c.CPU = val
+	case "DisableSelfUpdate":
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("DisableSelfUpdate: %w", err)
+		}
+		c.DisableSelfUpdate = b
+	case "DownloadTimeout":
+		c.DownloadTimeout = val
+	case "GithubUser":
+		c.GithubUser = val
+	case "GithubToken":
+		c.GithubToken = val
+	case "GithubVerbose":
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("GithubVerbose: %w", err)
+		}
+		c.GithubVerbose = b
+	case "LogRotateCount":
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("LogRotateCount: %w", err)
+		}
+		c.LogRotateCount = n
+	case "ExeRotateCount":
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("ExeRotateCount: %w", err)
+		}
+		c.ExeRotateCount = n
+	case "DownloadRetries":
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("DownloadRetries: %w", err)
+		}
+		c.DownloadRetries = n
+	case "DownloadBackoff":
+		c.DownloadBackoff = val
+	case "ProgressMode":
+		c.ProgressMode = val
+	}
+	return nil
+}
+
+func (c *config) getTargetDir() string {
+	if c.TargetDir == "" {
+		return "."
+	}
+	return c.TargetDir
+}
+
+func (c *config) getSource() string {
+	if c.Source == "" {
+		return "release"
+	}
+	return c.Source
+}
+
+const defaultDownloadTimeout = 30 * time.Second
+
+// getDownloadTimeout parses DownloadTimeout (e.g. "30s"), falling back to
+// defaultDownloadTimeout if it is unset or invalid.
+func (c *config) getDownloadTimeout() time.Duration {
+	d, err := time.ParseDuration(c.DownloadTimeout)
+	if err != nil {
+		return defaultDownloadTimeout
+	}
+	return d
+}
+
+func (c *config) getGithubUser() string {
+	return c.GithubUser
+}
+
+func (c *config) getGithubToken() string {
+	return c.GithubToken
+}
+
+// getDownloadBackoff parses DownloadBackoff (e.g. "2s"), falling back to the
+// package-level downloadBackoff default (source.go) if it is unset or
+// invalid.
+func (c *config) getDownloadBackoff() time.Duration {
+	d, err := time.ParseDuration(c.DownloadBackoff)
+	if err != nil {
+		return downloadBackoff
+	}
+	return d
+}
+
+// getCustomSources returns the [CustomSource] overrides, keyed by source
+// type name with an optional ".<arch>" suffix, for setup() to resolve with
+// toSourceType and setupCustomSource.
+func (c *config) getCustomSources() map[string]string {
+	return c.CustomSources
+}
+
+// getProgressMode returns ProgressMode for selectProgressFactory.
+func (c *config) getProgressMode() string {
+	return c.ProgressMode
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/koron/netupvim/netup"
 )
@@ -19,6 +20,9 @@ var (
 	cpu        string
 	restore    bool
 	selfUpdate = true
+
+	applyMode    = false
+	applyWorkDir = ""
 )
 
 func setup() error {
@@ -34,6 +38,9 @@ func setup() error {
 		sourceOpt  = flag.String("s", conf.getSource(), "source of update: release,develop,canary")
 		restoreOpt = flag.Bool("restore", false, "force download & extract all files")
 		versionOpt = flag.Bool("version", false, "show version")
+
+		applyOpt        = flag.Bool("apply", false, "(internal) apply a staged self-update")
+		applyWorkDirOpt = flag.String("apply-workdir", "", "(internal) work dir of the staged self-update")
 	)
 	flag.Parse()
 	if *helpOpt {
@@ -51,6 +58,8 @@ func setup() error {
 	restore = *restoreOpt
 	cpu = conf.CPU
 	selfUpdate = !conf.DisableSelfUpdate
+	applyMode = *applyOpt
+	applyWorkDir = *applyWorkDirOpt
 
 	netup.Version = version
 	netup.DownloadTimeout = conf.getDownloadTimeout()
@@ -63,6 +72,25 @@ func setup() error {
 	if conf.ExeRotateCount > 0 {
 		netup.ExeRotateCount = conf.ExeRotateCount
 	}
+	if conf.DownloadRetries > 0 {
+		downloadRetries = conf.DownloadRetries
+	}
+	downloadBackoff = conf.getDownloadBackoff()
+	newProgress = selectProgressFactory(conf.getProgressMode())
+	for name, raw := range conf.getCustomSources() {
+		// A key may carry an optional per-arch suffix, e.g.
+		// "release.x86" vs. a type-wide "release".
+		typeName, archName, _ := strings.Cut(name, ".")
+		st, err := toSourceType(typeName)
+		if err != nil {
+			netup.LogInfo("ignoring custom source for %q: %s", name, err)
+			continue
+		}
+		if err := setupCustomSource(st, archName, raw); err != nil {
+			netup.LogInfo("ignoring custom source for %q: %s", name, err)
+			continue
+		}
+	}
 
 	return nil
 }
@@ -75,17 +103,30 @@ func shouldSelfUpdate() bool {
 	return err == nil
 }
 
-func run() error {
+func run() (err error) {
 	if err := setup(); err != nil {
 		return err
 	}
+	if applyMode {
+		return runApply(applyWorkDir)
+	}
 	workDir := filepath.Join(targetDir, "netupvim")
+	// Both phases below report through one aggregate, so the user sees a
+	// single running total rather than the bar resetting between them.
+	agg := newAggregateProgress(newProgress())
+	defaultProgress = agg
+	defer func() {
+		if err == nil {
+			agg.Done()
+		}
+	}()
+
 	// update vim
 	vimPack, ok := vimSet[sourceName]
 	if !ok {
 		return fmt.Errorf("invalid source: %s", sourceName)
 	}
-	err := netup.Update(
+	err = netup.Update(
 		targetDir,
 		workDir,
 		vimPack,
@@ -94,17 +135,17 @@ func run() error {
 	if err != nil {
 		return err
 	}
-	// try to update netupvim
+	// try to update netupvim: stage the new exe, then hand off to a
+	// detached helper that swaps it in once this process has exited.
 	if shouldSelfUpdate() {
 		netup.LogInfo("trying to update netupvim")
-		err := netup.Update(
-			targetDir,
-			workDir,
-			netupPack,
-			netup.Arch{Name: "X86"},
-			restore)
+		m, err := stageSelfUpdate(targetDir, workDir, restore)
 		if err != nil {
-			netup.LogInfo("failed to udate netupvim: %s", err)
+			netup.LogInfo("failed to stage netupvim update: %s", err)
+		} else if err := spawnApply(workDir); err != nil {
+			netup.LogInfo("failed to launch self-update helper: %s", err)
+		} else {
+			netup.LogInfo("netupvim will finish updating %d file(s) after exit", len(m.Files))
 		}
 	}
 	return nil
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// Progress reports the state of one or more downloads. Start begins a named
+// transfer of the given total size (total may be negative if unknown),
+// Advance reports n more bytes transferred, and Finish marks the transfer
+// done (err nil on success).
+type Progress interface {
+	Start(name string, total int64)
+	Advance(n int64)
+	Finish(err error)
+}
+
+// newProgress builds the Progress backend selected by netupvim.ini's
+// ProgressMode; set from setup().
+var newProgress = newConsoleProgress
+
+// selectProgressFactory maps a ProgressMode ini value to a Progress
+// constructor, defaulting to the console backend.
+func selectProgressFactory(mode string) func() Progress {
+	switch mode {
+	case "json":
+		return newJSONProgress
+	case "silent":
+		return newSilentProgress
+	default:
+		return newConsoleProgress
+	}
+}
+
+// silentProgress discards all reporting.
+type silentProgress struct{}
+
+func newSilentProgress() Progress { return silentProgress{} }
+
+func (silentProgress) Start(name string, total int64) {}
+func (silentProgress) Advance(n int64)                {}
+func (silentProgress) Finish(err error)               {}
+
+// jsonProgress emits one JSON object per line to stdout, for consumption by
+// other tooling wrapping netupvim.
+type jsonProgress struct {
+	enc *json.Encoder
+}
+
+func newJSONProgress() Progress {
+	return &jsonProgress{enc: json.NewEncoder(os.Stdout)}
+}
+
+func (p *jsonProgress) Start(name string, total int64) {
+	p.emit("start", name, 0, total, nil)
+}
+
+func (p *jsonProgress) Advance(n int64) {
+	p.emit("advance", "", n, 0, nil)
+}
+
+func (p *jsonProgress) Finish(err error) {
+	p.emit("finish", "", 0, 0, err)
+}
+
+func (p *jsonProgress) emit(event, name string, n, total int64, err error) {
+	rec := struct {
+		Time  time.Time `json:"time"`
+		Event string    `json:"event"`
+		Name  string    `json:"name,omitempty"`
+		N     int64     `json:"n,omitempty"`
+		Total int64     `json:"total,omitempty"`
+		Error string    `json:"error,omitempty"`
+	}{
+		Time:  time.Now(),
+		Event: event,
+		Name:  name,
+		N:     n,
+		Total: total,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	p.enc.Encode(&rec)
+}
+
+// consoleProgress renders a single-line bar with ETA and throughput to
+// stderr. Throughput is smoothed with an EWMA over roughly the last 5s of
+// Advance calls, so it doesn't jitter with io.Copy's bursty writes.
+type consoleProgress struct {
+	name        string
+	total, done int64
+	lastT       time.Time
+	rate        float64 // bytes/sec, EWMA
+}
+
+const consoleRateHalfLife = 5 * time.Second
+
+func newConsoleProgress() Progress {
+	return &consoleProgress{}
+}
+
+func (p *consoleProgress) Start(name string, total int64) {
+	p.name = name
+	p.total = total
+	p.done = 0
+	p.rate = 0
+	p.lastT = time.Now()
+	p.render()
+}
+
+func (p *consoleProgress) Advance(n int64) {
+	now := time.Now()
+	dt := now.Sub(p.lastT)
+	p.done += n
+	if dt > 0 {
+		inst := float64(n) / dt.Seconds()
+		alpha := 1 - math.Exp(-dt.Seconds()/consoleRateHalfLife.Seconds())
+		if p.rate == 0 {
+			p.rate = inst
+		} else {
+			p.rate += alpha * (inst - p.rate)
+		}
+	}
+	p.lastT = now
+	p.render()
+}
+
+func (p *consoleProgress) Finish(err error) {
+	p.render()
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: failed: %s\n", p.name, err)
+	}
+}
+
+func (p *consoleProgress) render() {
+	var pct float64
+	if p.total > 0 {
+		pct = float64(p.done) / float64(p.total) * 100
+	}
+	const width = 20
+	filled := int(pct / 100 * width)
+	if filled > width {
+		filled = width
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	eta := "?"
+	if p.rate > 0 && p.total > p.done {
+		remain := time.Duration(float64(p.total-p.done)/p.rate) * time.Second
+		eta = remain.Truncate(time.Second).String()
+	}
+	fmt.Fprintf(os.Stderr, "\r%-24s [%s] %5.1f%%  %6.1fKB/s  ETA %-8s",
+		p.name, bar, pct, p.rate/1024, eta)
+}
+
+// aggregateProgress combines Start/Advance calls from several sequential
+// transfers (e.g. the vim and netupvim self-update phases) into a single
+// running total reported to out, so the user sees one combined progress
+// stream instead of it resetting between files. Call Done once all phases
+// have completed.
+type aggregateProgress struct {
+	out         Progress
+	label       string
+	total, done int64
+
+	// curName/curTotal track the logical transfer currently contributing
+	// to total, so a retried Start for the same name (source.go's download
+	// retry loop calls saveBody, and so Start, again on every attempt)
+	// replaces its prior contribution instead of re-adding it.
+	curName  string
+	curTotal int64
+}
+
+func newAggregateProgress(out Progress) *aggregateProgress {
+	return &aggregateProgress{out: out, label: "update"}
+}
+
+func (a *aggregateProgress) Start(name string, total int64) {
+	if name == a.curName {
+		a.total -= a.curTotal
+		a.curTotal = 0
+	} else {
+		a.curName = name
+		a.curTotal = 0
+	}
+	if total > 0 {
+		a.curTotal = total
+		a.total += total
+	}
+	a.out.Start(a.label, a.total)
+}
+
+func (a *aggregateProgress) Advance(n int64) {
+	a.done += n
+	a.out.Advance(n)
+}
+
+// Finish reports a failure immediately but otherwise defers to Done, since
+// one phase finishing isn't the end of the aggregate transfer.
+func (a *aggregateProgress) Finish(err error) {
+	if err != nil {
+		a.out.Finish(err)
+	}
+}
+
+// Done finalizes the aggregate after all phases have completed successfully.
+func (a *aggregateProgress) Done() {
+	a.out.Finish(nil)
+}
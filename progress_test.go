@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// recordingProgress records every call made to it, for asserting on what an
+// aggregateProgress forwards downstream.
+type recordingProgress struct {
+	starts []int64 // total passed to each Start call
+}
+
+func (r *recordingProgress) Start(name string, total int64) { r.starts = append(r.starts, total) }
+func (r *recordingProgress) Advance(n int64)                {}
+func (r *recordingProgress) Finish(err error)               {}
+
+func TestAggregateProgressStartRetryDoesNotAccumulate(t *testing.T) {
+	out := &recordingProgress{}
+	a := newAggregateProgress(out)
+
+	// First phase: one file, first attempt sees a 100-byte body.
+	a.Start("vim.zip", 100)
+	// A retry of the same logical transfer reports a larger, offset-
+	// inclusive length; it must replace, not add to, the prior total.
+	a.Start("vim.zip", 140)
+
+	if a.total != 140 {
+		t.Errorf("total after retried Start = %d, want 140", a.total)
+	}
+
+	// A second, distinct file in the same run adds on top of the first.
+	a.Start("netupvim.exe", 60)
+	if a.total != 200 {
+		t.Errorf("total after second file's Start = %d, want 200", a.total)
+	}
+
+	want := []int64{100, 140, 200}
+	if len(out.starts) != len(want) {
+		t.Fatalf("out.starts = %v, want %v", out.starts, want)
+	}
+	for i, w := range want {
+		if out.starts[i] != w {
+			t.Errorf("out.starts[%d] = %d, want %d", i, out.starts[i], w)
+		}
+	}
+}
+
+func TestConsoleProgressRateEWMA(t *testing.T) {
+	p := &consoleProgress{}
+	p.Start("f", 1000)
+
+	// Back-date lastT so Advance sees a controlled ~1s elapsed and an
+	// instantaneous rate of ~100 B/s.
+	p.lastT = time.Now().Add(-time.Second)
+	p.Advance(100)
+	if p.rate <= 0 {
+		t.Fatalf("rate after first Advance = %v, want > 0", p.rate)
+	}
+	firstRate := p.rate
+
+	// A much higher instantaneous rate should pull the EWMA up, but a
+	// single sample shouldn't jump it straight to the new instantaneous
+	// value.
+	p.lastT = time.Now().Add(-time.Second)
+	p.Advance(900)
+	if p.rate <= firstRate {
+		t.Errorf("rate did not increase toward higher instantaneous rate: got %v, prev %v", p.rate, firstRate)
+	}
+	if p.rate >= 900 {
+		t.Errorf("rate = %v, should be smoothed below the instantaneous 900 B/s sample", p.rate)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/koron/netupvim/netup"
+)
+
+const (
+	selfExeName        = "netupvim.exe"
+	stagedSuffix       = ".new"
+	backupSuffix       = ".bak"
+	stagedManifestName = "staged.json"
+)
+
+var errSmokeTestFailed = errors.New("staged self-update failed its smoke test")
+
+// stagedFile describes one live file to be swapped for a staged replacement.
+type stagedFile struct {
+	Path   string `json:"path"`   // absolute path of the live file to replace
+	Staged string `json:"staged"` // absolute path of the downloaded replacement
+	Backup string `json:"backup"` // absolute path the previous file is moved to
+	Sum    string `json:"sum"`    // expected SHA256 of Staged
+}
+
+type stagedManifest struct {
+	Files []stagedFile `json:"files"`
+}
+
+func stagedManifestPath(workDir string) string {
+	return filepath.Join(workDir, stagedManifestName)
+}
+
+// stageSelfUpdate downloads the new netupvim.exe into a scratch dir under
+// workDir and records a manifest describing how to apply it, without
+// touching the live executable.
+func stageSelfUpdate(targetDir, workDir string, restore bool) (stagedManifest, error) {
+	stageDir := filepath.Join(workDir, "stage")
+	if err := os.MkdirAll(stageDir, 0755); err != nil {
+		return stagedManifest{}, err
+	}
+	if err := netup.Update(
+		stageDir,
+		workDir,
+		netupPack,
+		netup.Arch{Name: "X86"},
+		restore); err != nil {
+		return stagedManifest{}, err
+	}
+	live := filepath.Join(targetDir, selfExeName)
+	staged := live + stagedSuffix
+	if err := os.Rename(filepath.Join(stageDir, selfExeName), staged); err != nil {
+		return stagedManifest{}, err
+	}
+	sum, err := fileSHA256(staged)
+	if err != nil {
+		return stagedManifest{}, err
+	}
+	m := stagedManifest{Files: []stagedFile{{
+		Path:   live,
+		Staged: staged,
+		Backup: live + backupSuffix,
+		Sum:    sum,
+	}}}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return stagedManifest{}, err
+	}
+	if err := ioutil.WriteFile(stagedManifestPath(workDir), b, 0644); err != nil {
+		return stagedManifest{}, err
+	}
+	return m, nil
+}
+
+// spawnApply launches a detached copy of the current executable with -apply
+// to swap in the staged files once this process has exited.
+func spawnApply(workDir string) error {
+	cmd := exec.Command(os.Args[0], "-apply", "-apply-workdir", workDir)
+	return cmd.Start()
+}
+
+// runApply is the entry point for the detached helper process (-apply): it
+// waits for the live executable to become replaceable, swaps in the staged
+// files, smoke-tests the result, and rolls back on failure.
+func runApply(workDir string) error {
+	m, err := loadStagedManifest(workDir)
+	if err != nil {
+		return err
+	}
+	var applied []stagedFile
+	for _, sf := range m.Files {
+		if err := sf.apply(); err != nil {
+			sf.rollback()
+			rollbackAll(applied)
+			return err
+		}
+		applied = append(applied, sf)
+	}
+	if err := smokeTest(m); err != nil {
+		rollbackAll(m.Files)
+		return err
+	}
+	for _, sf := range m.Files {
+		rotateBackup(sf.Backup)
+	}
+	os.Remove(stagedManifestPath(workDir))
+	netup.LogInfo("self-update applied successfully")
+	return nil
+}
+
+// rollbackAll restores every file in files from its backup, best-effort. It
+// is used both when one file in a multi-file manifest fails to apply (so an
+// earlier, already-swapped file isn't left half-updated) and when the
+// post-apply smoke test fails.
+func rollbackAll(files []stagedFile) {
+	for _, sf := range files {
+		sf.rollback()
+	}
+}
+
+func loadStagedManifest(workDir string) (stagedManifest, error) {
+	b, err := ioutil.ReadFile(stagedManifestPath(workDir))
+	if err != nil {
+		return stagedManifest{}, err
+	}
+	var m stagedManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return stagedManifest{}, err
+	}
+	return m, nil
+}
+
+// apply swaps sf.Staged into sf.Path, retrying briefly while the live file
+// is still locked by the exiting parent process.
+func (sf stagedFile) apply() error {
+	if sf.Sum != "" {
+		if err := verifyFileChecksum(sf.Staged, sf.Sum); err != nil {
+			return err
+		}
+	}
+	var err error
+	for attempt := 0; attempt < 30; attempt++ {
+		if err = os.Rename(sf.Path, sf.Backup); err == nil {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if err != nil {
+		return fmt.Errorf("could not replace %s, it may still be running: %w", sf.Path, err)
+	}
+	if err := os.Rename(sf.Staged, sf.Path); err != nil {
+		os.Rename(sf.Backup, sf.Path)
+		return err
+	}
+	return nil
+}
+
+// rollback restores sf.Path from its backup, best-effort.
+func (sf stagedFile) rollback() {
+	if _, err := os.Stat(sf.Backup); err != nil {
+		return
+	}
+	os.Remove(sf.Path)
+	if err := os.Rename(sf.Backup, sf.Path); err != nil {
+		netup.LogInfo("failed to roll back %s: %s", sf.Path, err)
+	}
+}
+
+// rotateBackup keeps at most netup.ExeRotateCount numbered copies of a
+// successful update's backup, the same rotation knob netup itself uses.
+func rotateBackup(path string) {
+	if netup.ExeRotateCount <= 0 {
+		os.Remove(path)
+		return
+	}
+	for i := netup.ExeRotateCount - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	os.Rename(path, fmt.Sprintf("%s.1", path))
+}
+
+// smokeTest runs a minimal sanity check against the freshly-applied files
+// before declaring the update successful.
+func smokeTest(m stagedManifest) error {
+	if len(m.Files) == 0 {
+		return nil
+	}
+	targetDir := filepath.Dir(m.Files[0].Path)
+	checks := []struct {
+		path, arg string
+		okExit    int // exit status the command reports on success
+	}{
+		{filepath.Join(targetDir, "vim.exe"), "--version", 0},
+		// netupvim's -version prints its version and exits with status 1.
+		{filepath.Join(targetDir, selfExeName), "-version", 1},
+	}
+	for _, c := range checks {
+		if _, err := os.Stat(c.path); err != nil {
+			continue
+		}
+		err := exec.Command(c.path, c.arg).Run()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == c.okExit {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s %s: %s", errSmokeTestFailed, c.path, c.arg, err)
+		}
+	}
+	return nil
+}
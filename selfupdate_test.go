@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/koron/netupvim/netup"
+)
+
+func TestRotateBackupZero(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "netupvim.exe.bak")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	old := netup.ExeRotateCount
+	netup.ExeRotateCount = 0
+	defer func() { netup.ExeRotateCount = old }()
+
+	rotateBackup(path)
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("rotateBackup with count 0 should remove %s, stat err = %v", path, err)
+	}
+}
+
+func TestRotateBackupKeepsCount(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "netupvim.exe.bak")
+
+	old := netup.ExeRotateCount
+	netup.ExeRotateCount = 2
+	defer func() { netup.ExeRotateCount = old }()
+
+	// First rotation: path -> path.1
+	if err := os.WriteFile(path, []byte("gen0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rotateBackup(path)
+	assertContents(t, path+".1", "gen0")
+
+	// Second rotation: path -> path.1 (shifting the old one to path.2)
+	if err := os.WriteFile(path, []byte("gen1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rotateBackup(path)
+	assertContents(t, path+".1", "gen1")
+	assertContents(t, path+".2", "gen0")
+
+	// A third rotation must not grow beyond ExeRotateCount: path.2 (gen0)
+	// falls off.
+	if err := os.WriteFile(path, []byte("gen2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rotateBackup(path)
+	assertContents(t, path+".1", "gen2")
+	assertContents(t, path+".2", "gen1")
+}
+
+func TestRunApplyRollsBackEarlierFilesOnFailure(t *testing.T) {
+	workDir := t.TempDir()
+
+	live1 := filepath.Join(workDir, "a.exe")
+	staged1 := live1 + stagedSuffix
+	backup1 := live1 + backupSuffix
+	if err := os.WriteFile(live1, []byte("old-a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(staged1, []byte("new-a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	live2 := filepath.Join(workDir, "b.exe")
+	staged2 := live2 + stagedSuffix // deliberately not created, to force the second file's apply to fail
+	backup2 := live2 + backupSuffix
+	if err := os.WriteFile(live2, []byte("old-b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := stagedManifest{Files: []stagedFile{
+		{Path: live1, Staged: staged1, Backup: backup1},
+		{Path: live2, Staged: staged2, Backup: backup2},
+	}}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stagedManifestPath(workDir), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runApply(workDir); err == nil {
+		t.Fatal("runApply: expected an error from the missing staged2, got nil")
+	}
+
+	assertContents(t, live1, "old-a")
+	if _, err := os.Stat(backup1); !os.IsNotExist(err) {
+		t.Errorf("backup1 should have been restored away by rollback, stat err = %v", err)
+	}
+	assertContents(t, live2, "old-b")
+}
+
+func assertContents(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %s", path, err)
+	}
+	if string(got) != want {
+		t.Errorf("%s = %q, want %q", path, got, want)
+	}
+}
@@ -1,20 +1,41 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gabstv/go-bsdiff/pkg/bspatch"
 	"github.com/koron/go-arch"
 	"github.com/koron/go-github"
+	"github.com/koron/netupvim/netup"
 )
 
+// downloadRetries and downloadBackoff control the retry loop wrapped around
+// download; they are overridden from netupvim.ini in setup().
+var (
+	downloadRetries = 3
+	downloadBackoff = 2 * time.Second
+)
+
+// defaultProgress is used by download when called with a nil Progress; run
+// replaces it with an aggregateProgress so the vim and netupvim update
+// phases report into one combined total.
+var defaultProgress Progress = silentProgress{}
+
 var (
 	errUnknownSource     = errors.New("unknown source")
 	errSourceNotFound    = errors.New("source not found")
@@ -23,6 +44,9 @@ var (
 	errGithubNoRelease       = errors.New("absence of github release")
 	errGithubNoAssets        = errors.New("no matched assets in github release")
 	errGithubIncompleteAsset = errors.New("incomplete github asset")
+
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errChecksumNotFound = errors.New("checksum not found in manifest")
 )
 
 type sourceType int
@@ -45,50 +69,97 @@ func toSourceType(s string) (sourceType, error) {
 	return 0, errUnknownSource
 }
 
-type progressFunc func(curr, max int64)
-
 type source interface {
 	// download downloads source file to outdir, return its path name.
 	// if pivot is not zero, this checks changes of source from pivot.
-	download(outdir string, pivot time.Time, f progressFunc) (path string, err error)
+	download(outdir string, pivot time.Time, prog Progress) (path string, err error)
 }
 
 type directSource struct {
 	url string
+
+	// sumURL, if set, points to a checksum manifest in the same
+	// "<hex digest>  <filename>" format as githubSource's checksum asset.
+	// It is fetched and compared against url's downloaded file before
+	// accepting it.
+	sumURL string
 }
 
 var _ source = (*directSource)(nil)
 
-func (ds *directSource) download(d string, p time.Time, f progressFunc) (string, error) {
-	return download(ds.url, d, p, f)
+func (ds *directSource) download(d string, p time.Time, prog Progress) (string, error) {
+	sum, err := ds.fetchChecksum()
+	if err != nil {
+		return "", err
+	}
+	return download(ds.url, d, p, prog, sum)
+}
+
+// fetchChecksum fetches ds.sumURL and looks up the digest for ds.url's
+// filename. It returns "" without error when no sumURL is configured.
+func (ds *directSource) fetchChecksum() (string, error) {
+	if ds.sumURL == "" {
+		return "", nil
+	}
+	name, err := urlBasename(ds.url)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.Get(ds.sumURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return parseChecksum(string(body), name)
+}
+
+// urlBasename returns the file name component of a URL's path.
+func urlBasename(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(u.Path), nil
 }
 
 type githubSource struct {
 	user    string
 	project string
 	namePat *regexp.Regexp
+
+	// checksumPat matches the companion asset (e.g. "SHA256SUMS") which
+	// lists the expected SHA256 digest of the downloaded asset. When nil,
+	// no checksum verification is performed.
+	checksumPat *regexp.Regexp
 }
 
 var _ source = (*githubSource)(nil)
 
-func (gs *githubSource) download(d string, p time.Time, f progressFunc) (string, error) {
-	a, err := gs.fetchAsset()
+func (gs *githubSource) download(d string, p time.Time, prog Progress) (string, error) {
+	a, sum, err := gs.fetchAsset()
 	if err != nil {
 		return "", err
 	}
 	if !p.IsZero() && p.After(a.UpdatedAt) {
 		return "", errSourceNotModified
 	}
-	return download(a.DownloadURL, d, p, f)
+	return download(a.DownloadURL, d, p, prog, sum)
 }
 
-func (gs *githubSource) fetchAsset() (*github.Asset, error) {
+func (gs *githubSource) fetchAsset() (*github.Asset, string, error) {
 	r, err := github.Latest(gs.user, gs.project)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	if r.Draft || r.PreRelease {
-		return nil, errGithubNoRelease
+		return nil, "", errGithubNoRelease
 	}
 	var t *github.Asset
 	for _, a := range r.Assets {
@@ -98,46 +169,593 @@ func (gs *githubSource) fetchAsset() (*github.Asset, error) {
 		}
 	}
 	if t == nil {
-		return nil, errGithubNoAssets
+		return nil, "", errGithubNoAssets
 	}
 	if t.State != "uploaded" {
-		return nil, errGithubIncompleteAsset
+		return nil, "", errGithubIncompleteAsset
+	}
+	if gs.checksumPat == nil {
+		return t, "", nil
+	}
+	sum, err := gs.fetchChecksum(r, t.Name)
+	if err != nil {
+		return nil, "", err
+	}
+	return t, sum, nil
+}
+
+// fetchChecksum locates the checksum manifest asset in r and returns the
+// digest recorded for name.
+func (gs *githubSource) fetchChecksum(r *github.Release, name string) (string, error) {
+	var m *github.Asset
+	for _, a := range r.Assets {
+		if gs.checksumPat.MatchString(a.Name) {
+			m = &a
+			break
+		}
+	}
+	if m == nil {
+		return "", errChecksumNotFound
+	}
+	resp, err := http.Get(m.DownloadURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return parseChecksum(string(body), name)
+}
+
+// parseChecksum extracts the digest for name out of a "SHA256SUMS" style
+// manifest: lines of "<hex digest>  <filename>".
+func parseChecksum(manifest, name string) (string, error) {
+	s := bufio.NewScanner(strings.NewReader(manifest))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", errChecksumNotFound
+}
+
+var errPatchAssetNotFound = errors.New("no matching patch asset in github release")
+
+// versionRecord remembers which release is currently installed and where its
+// full archive was cached, so a later update can fetch a small patch instead
+// of the whole archive again.
+type versionRecord struct {
+	Version string `json:"version"`
+	Archive string `json:"archive"`
+}
+
+func versionFilePath(d string) string {
+	return filepath.Join(d, "version.json")
+}
+
+func loadVersionRecord(d string) (versionRecord, bool) {
+	b, err := ioutil.ReadFile(versionFilePath(d))
+	if err != nil {
+		return versionRecord{}, false
+	}
+	var rec versionRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return versionRecord{}, false
+	}
+	return rec, rec.Version != "" && rec.Archive != ""
+}
+
+func saveVersionRecord(d string, rec versionRecord) error {
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(versionFilePath(d), b, 0644)
+}
+
+// patchSource wraps a githubSource, downloading a small bsdiff patch against
+// the previously-installed archive (tracked in d/version.json) instead of
+// the full release archive, falling back to a full download when no patch
+// asset matches or the cached base archive is gone.
+type patchSource struct {
+	base *githubSource
+
+	// patchPatFmt is a regexp pattern, with one %s for the installed
+	// version, matching the patch asset for an update from that version
+	// (e.g. "^vim-kaoriya-%s-to-.*\\.bsdiff$").
+	patchPatFmt string
+}
+
+var _ source = (*patchSource)(nil)
+
+func (ps *patchSource) download(d string, p time.Time, prog Progress) (string, error) {
+	r, err := github.Latest(ps.base.user, ps.base.project)
+	if err != nil {
+		return "", err
+	}
+	if r.Draft || r.PreRelease {
+		return "", errGithubNoRelease
+	}
+	if !p.IsZero() && p.After(r.PublishedAt) {
+		return "", errSourceNotModified
+	}
+	if rec, ok := loadVersionRecord(d); ok && rec.Version != r.Name {
+		path, err := ps.tryPatch(d, r, rec)
+		if err == nil {
+			return path, nil
+		}
+		netup.LogInfo("patch update failed, falling back to full download: %s", err)
+	}
+	path, err := ps.base.download(d, p, prog)
+	if err != nil {
+		return "", err
+	}
+	if err := saveVersionRecord(d, versionRecord{Version: r.Name, Archive: path}); err != nil {
+		netup.LogInfo("failed to record installed version: %s", err)
+	}
+	return path, nil
+}
+
+// tryPatch reconstructs the release r's archive by applying a patch asset to
+// the cached base archive recorded in rec.
+func (ps *patchSource) tryPatch(d string, r *github.Release, rec versionRecord) (string, error) {
+	if _, err := os.Stat(rec.Archive); err != nil {
+		return "", fmt.Errorf("cached base archive not found: %w", err)
+	}
+	patchPat, err := regexp.Compile(fmt.Sprintf(ps.patchPatFmt, regexp.QuoteMeta(rec.Version)))
+	if err != nil {
+		return "", err
+	}
+	var patchAsset, fullAsset *github.Asset
+	for i, a := range r.Assets {
+		if patchAsset == nil && patchPat.MatchString(a.Name) {
+			patchAsset = &r.Assets[i]
+		}
+		if fullAsset == nil && ps.base.namePat.MatchString(a.Name) {
+			fullAsset = &r.Assets[i]
+		}
+	}
+	if patchAsset == nil || fullAsset == nil {
+		return "", errPatchAssetNotFound
+	}
+	patchPath, err := download(patchAsset.DownloadURL, d, time.Time{}, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(patchPath)
+
+	outPath, err := downloadFilepath(fullAsset.DownloadURL, d)
+	if err != nil {
+		return "", err
+	}
+	if err := bspatch.File(rec.Archive, outPath, patchPath); err != nil {
+		return "", err
+	}
+	if ps.base.checksumPat != nil {
+		sum, err := ps.base.fetchChecksum(r, fullAsset.Name)
+		if err != nil {
+			os.Remove(outPath)
+			return "", fmt.Errorf("could not verify patched archive checksum: %w", err)
+		}
+		if err := verifyFileChecksum(outPath, sum); err != nil {
+			os.Remove(outPath)
+			return "", err
+		}
+	}
+	if err := saveVersionRecord(d, versionRecord{Version: r.Name, Archive: outPath}); err != nil {
+		netup.LogInfo("failed to record installed version: %s", err)
+	}
+	return outPath, nil
+}
+
+// sourceProvider builds a source from a parsed "<scheme>://..." URL taken
+// from netupvim.ini, letting users point at hosts other than the built-in
+// github.com/koron/vim-kaoriya release.
+type sourceProvider func(u *url.URL) (source, error)
+
+var sourceProviders = map[string]sourceProvider{
+	"github":    newGithubSourceFromURL,
+	"gitea":     newGiteaSourceFromURL,
+	"gitlab":    newGitlabSourceFromURL,
+	"http+json": newHTTPJSONSourceFromURL,
+}
+
+var errUnknownScheme = errors.New("unknown source scheme")
+
+// newSource resolves rawurl (e.g. "gitea://git.example.com/user/proj?asset=...")
+// against sourceProviders.
+func newSource(rawurl string) (source, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := sourceProviders[u.Scheme]
+	if !ok {
+		return nil, errUnknownScheme
+	}
+	return p(u)
+}
+
+func newGithubSourceFromURL(u *url.URL) (source, error) {
+	project := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || project == "" {
+		return nil, fmt.Errorf("github source requires user and project: %s", u)
+	}
+	pat := u.Query().Get("asset")
+	if pat == "" {
+		return nil, fmt.Errorf("github source requires asset= query parameter")
+	}
+	namePat, err := regexp.Compile(pat)
+	if err != nil {
+		return nil, err
+	}
+	gs := &githubSource{user: u.Host, project: project, namePat: namePat}
+	if cs := u.Query().Get("checksum"); cs != "" {
+		checksumPat, err := regexp.Compile(cs)
+		if err != nil {
+			return nil, err
+		}
+		gs.checksumPat = checksumPat
+	}
+	if patchPatFmt := u.Query().Get("patch"); patchPatFmt != "" {
+		return &patchSource{base: gs, patchPatFmt: patchPatFmt}, nil
+	}
+	return gs, nil
+}
+
+// splitRepoPath splits a "/user/project" URL path into its two components.
+func splitRepoPath(p string) (user, project string, err error) {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("expected /user/project path, got %q", p)
+	}
+	return parts[0], parts[1], nil
+}
+
+// fetchJSON GETs rawurl and decodes the JSON response body into v.
+func fetchJSON(rawurl string, v interface{}) error {
+	resp, err := http.Get(rawurl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+var (
+	errGiteaNoRelease = errors.New("absence of gitea release")
+	errGiteaNoAssets  = errors.New("no matched assets in gitea release")
+)
+
+type giteaAsset struct {
+	Name               string `json:"name"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+}
+
+type giteaRelease struct {
+	Draft       bool         `json:"draft"`
+	Prerelease  bool         `json:"prerelease"`
+	PublishedAt time.Time    `json:"published_at"`
+	Assets      []giteaAsset `json:"assets"`
+}
+
+// giteaSource downloads a release asset from a self-hosted Gitea/Forgejo
+// instance's REST API.
+type giteaSource struct {
+	host, user, project string
+	namePat             *regexp.Regexp
+}
+
+var _ source = (*giteaSource)(nil)
+
+func newGiteaSourceFromURL(u *url.URL) (source, error) {
+	user, project, err := splitRepoPath(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	pat := u.Query().Get("asset")
+	if pat == "" {
+		return nil, fmt.Errorf("gitea source requires asset= query parameter")
+	}
+	namePat, err := regexp.Compile(pat)
+	if err != nil {
+		return nil, err
+	}
+	return &giteaSource{host: u.Host, user: user, project: project, namePat: namePat}, nil
+}
+
+func (gs *giteaSource) download(d string, p time.Time, prog Progress) (string, error) {
+	var r giteaRelease
+	endpoint := fmt.Sprintf("https://%s/api/v1/repos/%s/%s/releases/latest", gs.host, gs.user, gs.project)
+	if err := fetchJSON(endpoint, &r); err != nil {
+		return "", err
+	}
+	if r.Draft || r.Prerelease {
+		return "", errGiteaNoRelease
+	}
+	if !p.IsZero() && p.After(r.PublishedAt) {
+		return "", errSourceNotModified
+	}
+	var a *giteaAsset
+	for i := range r.Assets {
+		if gs.namePat.MatchString(r.Assets[i].Name) {
+			a = &r.Assets[i]
+			break
+		}
+	}
+	if a == nil {
+		return "", errGiteaNoAssets
+	}
+	return download(a.BrowserDownloadURL, d, p, prog, "")
+}
+
+var (
+	errGitlabNoRelease = errors.New("absence of gitlab release")
+	errGitlabNoAssets  = errors.New("no matched assets in gitlab release")
+)
+
+type gitlabAssetLink struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type gitlabRelease struct {
+	ReleasedAt time.Time `json:"released_at"`
+	Assets     struct {
+		Links []gitlabAssetLink `json:"links"`
+	} `json:"assets"`
+}
+
+// gitlabSource downloads a release asset from a GitLab (or self-hosted
+// GitLab) project's REST API.
+type gitlabSource struct {
+	host, project string
+	namePat       *regexp.Regexp
+}
+
+var _ source = (*gitlabSource)(nil)
+
+func newGitlabSourceFromURL(u *url.URL) (source, error) {
+	project := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || project == "" {
+		return nil, fmt.Errorf("gitlab source requires a project path: %s", u)
+	}
+	pat := u.Query().Get("asset")
+	if pat == "" {
+		return nil, fmt.Errorf("gitlab source requires asset= query parameter")
+	}
+	namePat, err := regexp.Compile(pat)
+	if err != nil {
+		return nil, err
+	}
+	return &gitlabSource{host: u.Host, project: project, namePat: namePat}, nil
+}
+
+func (gs *gitlabSource) download(d string, p time.Time, prog Progress) (string, error) {
+	var rs []gitlabRelease
+	endpoint := fmt.Sprintf("https://%s/api/v4/projects/%s/releases", gs.host, url.QueryEscape(gs.project))
+	if err := fetchJSON(endpoint, &rs); err != nil {
+		return "", err
+	}
+	if len(rs) == 0 {
+		return "", errGitlabNoRelease
+	}
+	r := rs[0]
+	if !p.IsZero() && p.After(r.ReleasedAt) {
+		return "", errSourceNotModified
+	}
+	var a *gitlabAssetLink
+	for i := range r.Assets.Links {
+		if gs.namePat.MatchString(r.Assets.Links[i].Name) {
+			a = &r.Assets.Links[i]
+			break
+		}
+	}
+	if a == nil {
+		return "", errGitlabNoAssets
+	}
+	return download(a.URL, d, p, prog, "")
+}
+
+// httpJSONSource downloads a release asset whose URL is found in an
+// arbitrary JSON document by following a dotted field path, e.g.
+// "http+json://example.com/releases.json?jq=assets.0.url". An optional
+// "updated" path resolves to the asset's last-modified time, used for the
+// same If-Modified-Since short-circuit the other providers apply.
+type httpJSONSource struct {
+	url       string
+	jq        string
+	updatedJQ string
+}
+
+var _ source = (*httpJSONSource)(nil)
+
+func newHTTPJSONSourceFromURL(u *url.URL) (source, error) {
+	q := u.Query()
+	jq := q.Get("jq")
+	if jq == "" {
+		return nil, fmt.Errorf("http+json source requires jq= query parameter")
+	}
+	updatedJQ := q.Get("updated")
+	target := *u
+	target.Scheme = "https"
+	if s := q.Get("scheme"); s != "" {
+		target.Scheme = s
+	}
+	q.Del("jq")
+	q.Del("updated")
+	q.Del("scheme")
+	target.RawQuery = q.Encode()
+	return &httpJSONSource{url: target.String(), jq: jq, updatedJQ: updatedJQ}, nil
+}
+
+func (hs *httpJSONSource) download(d string, p time.Time, prog Progress) (string, error) {
+	var doc interface{}
+	if err := fetchJSON(hs.url, &doc); err != nil {
+		return "", err
 	}
-	return t, nil
+	if !p.IsZero() && hs.updatedJQ != "" {
+		updatedAt, err := hs.fetchUpdatedAt(doc)
+		if err != nil {
+			return "", err
+		}
+		if p.After(updatedAt) {
+			return "", errSourceNotModified
+		}
+	}
+	v, err := jqLookup(doc, hs.jq)
+	if err != nil {
+		return "", err
+	}
+	assetURL, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("jq path %q did not resolve to a string", hs.jq)
+	}
+	return download(assetURL, d, p, prog, "")
+}
+
+// fetchUpdatedAt resolves updatedJQ against doc and parses it as an RFC3339
+// timestamp.
+func (hs *httpJSONSource) fetchUpdatedAt(doc interface{}) (time.Time, error) {
+	v, err := jqLookup(doc, hs.updatedJQ)
+	if err != nil {
+		return time.Time{}, err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("jq path %q did not resolve to a string", hs.updatedJQ)
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// jqLookup walks doc along a dotted field/index path, e.g. "assets.0.url".
+func jqLookup(doc interface{}, path string) (interface{}, error) {
+	cur := doc
+	for _, part := range strings.Split(path, ".") {
+		if part == "" {
+			continue
+		}
+		switch m := cur.(type) {
+		case map[string]interface{}:
+			v, ok := m[part]
+			if !ok {
+				return nil, fmt.Errorf("field %q not found", part)
+			}
+			cur = v
+		case []interface{}:
+			idx, err := strconv.Atoi(part)
+			if err != nil || idx < 0 || idx >= len(m) {
+				return nil, fmt.Errorf("index %q out of range", part)
+			}
+			cur = m[idx]
+		default:
+			return nil, fmt.Errorf("cannot index into %T with %q", cur, part)
+		}
+	}
+	return cur, nil
+}
+
+// customSources overrides a built-in sourceType's provider, per CPU
+// architecture, with a URL resolved via sourceProviders; set from
+// netupvim.ini in setup(). An ini entry with no arch suffix (e.g.
+// "release") is recorded for every arch.CPU by setupCustomSource, so a
+// lookup here only ever needs a single map access.
+var customSources = map[sourceType]map[arch.CPU]string{}
+
+// customSourceArchs resolves the optional per-arch suffix on a CustomSource
+// ini key ("release.x86", "release.amd64") to the arch.CPU(s) it scopes to.
+// An empty suffix (just "release") scopes to every architecture, matching
+// the built-in sources map's behavior for a single-arch mirror.
+func customSourceArchs(archName string) ([]arch.CPU, error) {
+	switch strings.ToLower(archName) {
+	case "":
+		return []arch.CPU{arch.X86, arch.AMD64}, nil
+	case "x86":
+		return []arch.CPU{arch.X86}, nil
+	case "amd64":
+		return []arch.CPU{arch.AMD64}, nil
+	}
+	return nil, fmt.Errorf("unknown arch %q", archName)
+}
+
+// setupCustomSource records raw (a "<scheme>://..." URL) as st's provider
+// for the CPU architecture(s) named by archName ("", "x86", or "amd64").
+func setupCustomSource(st sourceType, archName, raw string) error {
+	cpus, err := customSourceArchs(archName)
+	if err != nil {
+		return err
+	}
+	if customSources[st] == nil {
+		customSources[st] = map[arch.CPU]string{}
+	}
+	for _, cpu := range cpus {
+		customSources[st][cpu] = raw
+	}
+	return nil
 }
 
 var sources = map[sourceType]map[arch.CPU]source{
+	// releaseSource archives are multi-hundred-MB; wrap each arch's
+	// githubSource in a patchSource so a previously-installed version can
+	// be upgraded with a small bsdiff patch instead of the full zip.
 	releaseSource: {
-		arch.X86: &githubSource{
-			user:    "koron",
-			project: "vim-kaoriya",
-			namePat: regexp.MustCompile(`-win32-.*\.zip$`),
+		arch.X86: &patchSource{
+			base: &githubSource{
+				user:    "koron",
+				project: "vim-kaoriya",
+				namePat: regexp.MustCompile(`-win32-.*\.zip$`),
+			},
+			patchPatFmt: `^vim-kaoriya-win32-%s-to-.*\.bsdiff$`,
 		},
-		arch.AMD64: &githubSource{
-			user:    "koron",
-			project: "vim-kaoriya",
-			namePat: regexp.MustCompile(`-win64-.*\.zip$`),
+		arch.AMD64: &patchSource{
+			base: &githubSource{
+				user:    "koron",
+				project: "vim-kaoriya",
+				namePat: regexp.MustCompile(`-win64-.*\.zip$`),
+			},
+			patchPatFmt: `^vim-kaoriya-win64-%s-to-.*\.bsdiff$`,
 		},
 	},
 	developSource: {
 		arch.X86: &directSource{
-			url: "http://files.kaoriya.net/vim/vim74-kaoriya-win32.zip",
+			url:    "http://files.kaoriya.net/vim/vim74-kaoriya-win32.zip",
+			sumURL: "http://files.kaoriya.net/vim/vim74-kaoriya-win32.zip.sha256",
 		},
 		arch.AMD64: &directSource{
-			url: "http://files.kaoriya.net/vim/vim74-kaoriya-win64.zip",
+			url:    "http://files.kaoriya.net/vim/vim74-kaoriya-win64.zip",
+			sumURL: "http://files.kaoriya.net/vim/vim74-kaoriya-win64.zip.sha256",
 		},
 	},
 	canarySource: {
 		arch.X86: &directSource{
-			url: "http://files.kaoriya.net/vim/vim74-kaoriya-win32-test.zip",
+			url:    "http://files.kaoriya.net/vim/vim74-kaoriya-win32-test.zip",
+			sumURL: "http://files.kaoriya.net/vim/vim74-kaoriya-win32-test.zip.sha256",
 		},
 		arch.AMD64: &directSource{
-			url: "http://files.kaoriya.net/vim/vim74-kaoriya-win64-test.zip",
+			url:    "http://files.kaoriya.net/vim/vim74-kaoriya-win64-test.zip",
+			sumURL: "http://files.kaoriya.net/vim/vim74-kaoriya-win64-test.zip.sha256",
 		},
 	},
 }
 
 func determineSource(st sourceType, cpu arch.CPU) (source, error) {
+	if m, ok := customSources[st]; ok {
+		if raw, ok := m[cpu]; ok {
+			return newSource(raw)
+		}
+	}
 	m, ok := sources[st]
 	if !ok {
 		return nil, errSourceNotFound
@@ -157,7 +775,16 @@ func downloadFilepath(inURL, outdir string) (string, error) {
 	return filepath.Join(outdir, filepath.Base(u.Path)), nil
 }
 
-func downloadAsFile(inURL, outPath string, pivot time.Time, pf progressFunc) error {
+// partSuffix marks a download still in progress; it is renamed away once the
+// body has been fully received (and, if requested, its checksum verified).
+const partSuffix = ".part"
+
+// downloadAsFile downloads inURL to outPath, resuming from outPath+partSuffix
+// if a previous attempt left one behind.
+func downloadAsFile(inURL, outPath string, pivot time.Time, prog Progress, wantSum string) error {
+	partPath := outPath + partSuffix
+	offset := partFileSize(partPath)
+
 	req, err := http.NewRequest("GET", inURL, nil)
 	if err != nil {
 		return err
@@ -166,6 +793,9 @@ func downloadAsFile(inURL, outPath string, pivot time.Time, pf progressFunc) err
 		t := pivot.UTC().Format(http.TimeFormat)
 		req.Header.Set("If-Modified-Since", t)
 	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
@@ -174,7 +804,21 @@ func downloadAsFile(inURL, outPath string, pivot time.Time, pf progressFunc) err
 
 	switch resp.StatusCode {
 	case http.StatusOK:
-		return saveBody(outPath, resp, pf)
+		return finishDownload(partPath, outPath, resp, prog, 0, false, wantSum)
+	case http.StatusPartialContent:
+		start, err := parseContentRangeStart(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			// The server ignored our Range (or the asset changed between
+			// attempts and started somewhere else): trusting the body
+			// would silently corrupt the resumed file, so start over.
+			netup.LogInfo("resumed download started at an unexpected offset, restarting: %s", resp.Header.Get("Content-Range"))
+			os.Remove(partPath)
+			return downloadAsFile(inURL, outPath, pivot, prog, wantSum)
+		}
+		return finishDownload(partPath, outPath, resp, prog, offset, true, wantSum)
+	case http.StatusRequestedRangeNotSatisfiable:
+		os.Remove(partPath)
+		return downloadAsFile(inURL, outPath, pivot, prog, wantSum)
 	case http.StatusNotModified:
 		return errSourceNotModified
 	default:
@@ -182,43 +826,134 @@ func downloadAsFile(inURL, outPath string, pivot time.Time, pf progressFunc) err
 	}
 }
 
+// parseContentRangeStart extracts the start offset from a response's
+// "Content-Range: bytes <start>-<end>/<total>" header, as returned with a
+// 206 Partial Content.
+func parseContentRangeStart(h string) (int64, error) {
+	h = strings.TrimPrefix(h, "bytes ")
+	dash := strings.IndexByte(h, '-')
+	if dash < 0 {
+		return 0, fmt.Errorf("malformed Content-Range: %q", h)
+	}
+	return strconv.ParseInt(h[:dash], 10, 64)
+}
+
+func partFileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// finishDownload writes resp's body to partPath, verifies wantSum if given,
+// and atomically renames partPath to outPath on success.
+func finishDownload(partPath, outPath string, resp *http.Response, prog Progress, offset int64, resume bool, wantSum string) error {
+	if err := saveBody(partPath, resp, prog, offset, resume); err != nil {
+		return err
+	}
+	if wantSum != "" {
+		if err := verifyFileChecksum(partPath, wantSum); err != nil {
+			os.Remove(partPath)
+			return err
+		}
+	}
+	return os.Rename(partPath, outPath)
+}
+
 // download downloads URL and saves as a file to outdir, return its path name.
 // if pivot is not zero, this checks changes of source after pivot.
-func download(inURL, outdir string, pivot time.Time, f progressFunc) (string, error) {
+// if wantSum is not empty, the downloaded file's SHA256 digest must match it
+// or the file is removed and errChecksumMismatch is returned.
+// The attempt is retried with exponential backoff up to downloadRetries
+// times before giving up. A nil prog falls back to defaultProgress.
+func download(inURL, outdir string, pivot time.Time, prog Progress, wantSum string) (string, error) {
+	if prog == nil {
+		prog = defaultProgress
+	}
 	path, err := downloadFilepath(inURL, outdir)
 	if err != nil {
 		return "", err
 	}
-	if err := downloadAsFile(inURL, path, pivot, f); err != nil {
+	backoff := downloadBackoff
+	for attempt := 0; ; attempt++ {
+		err = downloadAsFile(inURL, path, pivot, prog, wantSum)
+		if err == nil || err == errSourceNotModified || attempt >= downloadRetries {
+			break
+		}
+		netup.LogInfo("download failed, retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if err != nil {
 		return "", err
 	}
 	return path, nil
 }
 
-func saveBody(outPath string, resp *http.Response, pf progressFunc) error {
-	f, err := os.Create(outPath)
+func saveBody(outPath string, resp *http.Response, prog Progress, offset int64, resume bool) error {
+	flag := os.O_CREATE | os.O_WRONLY
+	if resume {
+		flag |= os.O_APPEND
+	} else {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(outPath, flag, 0644)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	w := &progressWriter{w: f, f: pf, m: resp.ContentLength}
-	if _, err := io.Copy(w, resp.Body); err != nil {
+	total := resp.ContentLength
+	if total >= 0 {
+		total += offset
+	}
+	prog.Start(filepath.Base(outPath), total)
+	if offset > 0 {
+		prog.Advance(offset)
+	}
+	w := &progressWriter{w: f, prog: prog, n: offset, m: total}
+	_, err = io.Copy(w, resp.Body)
+	prog.Finish(err)
+	return err
+}
+
+// verifyFileChecksum hashes the file at path and compares it against wantSum.
+func verifyFileChecksum(path, wantSum string) error {
+	got, err := fileSHA256(path)
+	if err != nil {
 		return err
 	}
+	if got != wantSum {
+		return errChecksumMismatch
+	}
 	return nil
 }
 
+// fileSHA256 returns the hex-encoded SHA256 digest of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 type progressWriter struct {
 	w    io.Writer
-	f    progressFunc
+	prog Progress
 	n, m int64
 }
 
 func (w *progressWriter) Write(p []byte) (int, error) {
 	n, err := w.w.Write(p)
 	w.n += int64(n)
-	if w.f != nil {
-		w.f(w.n, w.m)
+	if w.prog != nil {
+		w.prog.Advance(int64(n))
 	}
 	return n, err
-}
\ No newline at end of file
+}
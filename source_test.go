@@ -0,0 +1,152 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/koron/go-arch"
+)
+
+func TestSplitRepoPath(t *testing.T) {
+	cases := []struct {
+		path          string
+		user, project string
+		wantErr       bool
+	}{
+		{path: "/koron/vim-kaoriya", user: "koron", project: "vim-kaoriya"},
+		{path: "koron/vim-kaoriya/", user: "koron", project: "vim-kaoriya"},
+		{path: "/koron", wantErr: true},
+		{path: "/koron/vim-kaoriya/extra", wantErr: true},
+		{path: "", wantErr: true},
+	}
+	for _, c := range cases {
+		user, project, err := splitRepoPath(c.path)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("splitRepoPath(%q): expected error, got none", c.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitRepoPath(%q): unexpected error: %s", c.path, err)
+			continue
+		}
+		if user != c.user || project != c.project {
+			t.Errorf("splitRepoPath(%q) = %q, %q; want %q, %q", c.path, user, project, c.user, c.project)
+		}
+	}
+}
+
+func TestJQLookup(t *testing.T) {
+	doc := map[string]interface{}{
+		"assets": []interface{}{
+			map[string]interface{}{"url": "https://example.com/a.zip"},
+			map[string]interface{}{"url": "https://example.com/b.zip"},
+		},
+	}
+
+	v, err := jqLookup(doc, "assets.1.url")
+	if err != nil {
+		t.Fatalf("jqLookup: unexpected error: %s", err)
+	}
+	if v != "https://example.com/b.zip" {
+		t.Errorf("jqLookup = %v, want https://example.com/b.zip", v)
+	}
+
+	if _, err := jqLookup(doc, "assets.5.url"); err == nil {
+		t.Error("jqLookup: expected out-of-range error, got none")
+	}
+	if _, err := jqLookup(doc, "missing.field"); err == nil {
+		t.Error("jqLookup: expected missing-field error, got none")
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	manifest := "deadbeef00112233445566778899aabbccddeeff00112233445566778899aa  vim-kaoriya-win32.zip\n" +
+		"ABCDEF00112233445566778899aabbccddeeff00112233445566778899aabb *vim-kaoriya-win64.zip\n" +
+		"not a manifest line\n"
+
+	sum, err := parseChecksum(manifest, "vim-kaoriya-win32.zip")
+	if err != nil {
+		t.Fatalf("parseChecksum: unexpected error: %s", err)
+	}
+	if want := "deadbeef00112233445566778899aabbccddeeff00112233445566778899aa"; sum != want {
+		t.Errorf("parseChecksum = %q, want %q", sum, want)
+	}
+
+	// The filename may be prefixed with "*" (sha256sum's binary mode
+	// marker) and the digest is lower-cased for comparison.
+	sum, err = parseChecksum(manifest, "vim-kaoriya-win64.zip")
+	if err != nil {
+		t.Fatalf("parseChecksum: unexpected error: %s", err)
+	}
+	if want := "abcdef00112233445566778899aabbccddeeff00112233445566778899aabb"; sum != want {
+		t.Errorf("parseChecksum = %q, want %q", sum, want)
+	}
+
+	if _, err := parseChecksum(manifest, "missing.zip"); err != errChecksumNotFound {
+		t.Errorf("parseChecksum(missing) = %v, want errChecksumNotFound", err)
+	}
+}
+
+func TestSetupCustomSourcePerArch(t *testing.T) {
+	old := customSources
+	customSources = map[sourceType]map[arch.CPU]string{}
+	defer func() { customSources = old }()
+
+	if err := setupCustomSource(developSource, "x86", "direct://win32-mirror"); err != nil {
+		t.Fatalf("setupCustomSource(x86): unexpected error: %s", err)
+	}
+	if err := setupCustomSource(developSource, "amd64", "direct://win64-mirror"); err != nil {
+		t.Fatalf("setupCustomSource(amd64): unexpected error: %s", err)
+	}
+
+	if got := customSources[developSource][arch.X86]; got != "direct://win32-mirror" {
+		t.Errorf("customSources[developSource][X86] = %q, want direct://win32-mirror", got)
+	}
+	if got := customSources[developSource][arch.AMD64]; got != "direct://win64-mirror" {
+		t.Errorf("customSources[developSource][AMD64] = %q, want direct://win64-mirror", got)
+	}
+
+	if err := setupCustomSource(canarySource, "", "direct://both"); err != nil {
+		t.Fatalf("setupCustomSource(\"\"): unexpected error: %s", err)
+	}
+	if got := customSources[canarySource][arch.X86]; got != "direct://both" {
+		t.Errorf("customSources[canarySource][X86] = %q, want direct://both", got)
+	}
+	if got := customSources[canarySource][arch.AMD64]; got != "direct://both" {
+		t.Errorf("customSources[canarySource][AMD64] = %q, want direct://both", got)
+	}
+
+	if err := setupCustomSource(releaseSource, "arm", "direct://nope"); err == nil {
+		t.Error("setupCustomSource(arm): expected error for unknown arch, got none")
+	}
+}
+
+func TestParseContentRangeStart(t *testing.T) {
+	cases := []struct {
+		header  string
+		want    int64
+		wantErr bool
+	}{
+		{header: "bytes 1024-2047/2048", want: 1024},
+		{header: "bytes 0-99/100", want: 0},
+		{header: "", wantErr: true},
+		{header: "bytes */2048", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := parseContentRangeStart(c.header)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseContentRangeStart(%q): expected error, got none", c.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseContentRangeStart(%q): unexpected error: %s", c.header, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseContentRangeStart(%q) = %d, want %d", c.header, got, c.want)
+		}
+	}
+}